@@ -0,0 +1,381 @@
+// License: GPLv3 Copyright: 2022, Kovid Goyal, <kovid at kovidgoyal.net>
+
+// Package ringbuf implements a lock-free, single-producer/single-consumer
+// byte ring buffer on top of shm.MMap. It gives kitty a zero-copy channel
+// to child helper processes (kittens, image decoders) that today have to
+// shuttle bytes through pipes.
+package ringbuf
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"kitty/tools/utils/shm"
+)
+
+const magic uint64 = 0x6b697474795262 // "kittyRb" in hex
+const format_version uint32 = 1
+
+// header_size is kept at a full page so the data area that follows it in
+// the MMap stays page aligned, which Region()/OpenAt() style consumers
+// rely on.
+const header_size = 4096
+
+var ErrNotPowerOfTwo = errors.New("ringbuf: capacity must be a power of two")
+var ErrTooSmall = errors.New("ringbuf: shm object is too small to hold its header and data area")
+var ErrBadMagic = errors.New("ringbuf: shm object does not contain a kitty ringbuf")
+var ErrVersionMismatch = errors.New("ringbuf: shm object was created by an incompatible version of this package")
+
+// header is laid out at the start of the first page of the backing MMap.
+// head is only ever written by the Consumer (the Producer only reads it),
+// tail is the reverse, which is what makes the algorithm below
+// safe without any locking.
+type header struct {
+	magic        uint64
+	version      uint32
+	_            uint32 // padding, keeps capacity 8 byte aligned
+	capacity     uint64
+	head         atomic.Uint64
+	tail         atomic.Uint64
+	producer_pid int32
+	consumer_pid int32
+}
+
+// ring holds the state shared by Producer and Consumer. The fd used to wake
+// a blocked WaitReadable/WaitWritable (an eventfd on Linux, a socketpair or
+// pipe elsewhere; it is posted to with write(2) and waited on with poll(2),
+// so a kqueue fd cannot be used) is not part of header: fds are process local, so it has to
+// be handed to the other end out-of-band, typically over SCM_RIGHTS, and
+// registered locally with SetNotifyFD.
+type ring struct {
+	m         shm.MMap
+	h         *header
+	data      []byte
+	mask      uint64
+	notify_fd int
+}
+
+func new_ring(m shm.MMap) (*ring, error) {
+	s := m.Slice()
+	if len(s) <= header_size {
+		return nil, ErrTooSmall
+	}
+	h := (*header)(unsafe.Pointer(&s[0]))
+	data := s[header_size:]
+	if uint64(len(data)) < h.capacity {
+		return nil, ErrTooSmall
+	}
+	return &ring{m: m, h: h, data: data[:h.capacity:h.capacity], mask: h.capacity - 1, notify_fd: -1}, nil
+}
+
+// SetNotifyFD registers a doorbell descriptor (an eventfd on Linux, a
+// connected socketpair/pipe on other platforms) that Write/Read post to on
+// every successful call, and that WaitReadable/WaitWritable poll() on
+// instead of busy-waiting. Both ends of a ring should be given the same fd,
+// shared out-of-band (typically over SCM_RIGHTS) since fds are process
+// local and are never written into the shm object itself. The fd is used
+// purely as a "something changed, re-check" signal: whichever side posts
+// to it does not need to be the side that wakes, both sides re-evaluate
+// their own condition (is_readable/is_writable) after waking.
+func (self *ring) SetNotifyFD(fd int) {
+	self.notify_fd = fd
+}
+
+// post_notify wakes up anyone blocked in WaitReadable/WaitWritable on the
+// other end of the ring via the shared doorbell fd. Errors are ignored: a
+// full eventfd counter (EAGAIN) just means a wakeup is already pending,
+// and if no notify fd was configured the other end is busy-waiting anyway.
+func post_notify(fd int) {
+	if fd < 0 {
+		return
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], 1)
+	unix.Write(fd, buf[:])
+}
+
+func (self *ring) Close() error {
+	return self.m.Close()
+}
+
+// Unlink removes the backing shm object's name (POSIX named shm on
+// darwin/freebsd, the /dev/shm fallback path on old Linux kernels, a no-op
+// for memfd) so it is no longer reachable by name; existing attached ends
+// keep working until they also Close(). Call this once, typically from
+// whichever end called NewShared(), after every Consumer has attached.
+func (self *ring) Unlink() error {
+	return self.m.Unlink()
+}
+
+func (self *ring) is_readable() bool {
+	return self.h.tail.Load() != self.h.head.Load()
+}
+
+func (self *ring) is_writable() bool {
+	return self.h.tail.Load()-self.h.head.Load() < self.h.capacity
+}
+
+func (self *ring) wait(ctx context.Context, ready func() bool) error {
+	if ready() {
+		return nil
+	}
+	backoff := 50 * time.Microsecond
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if self.notify_fd >= 0 {
+			if err := self.poll_notify_fd(ctx); err != nil {
+				return err
+			}
+		} else {
+			time.Sleep(backoff)
+			if backoff < 4*time.Millisecond {
+				backoff *= 2
+			}
+		}
+		if ready() {
+			return nil
+		}
+	}
+}
+
+// poll_notify_fd blocks in short slices so ctx cancellation is noticed
+// promptly, rather than doing one long poll(2) call. Once POLLIN fires it
+// drains the doorbell's counter so the next poll() only returns once
+// another post_notify() actually happens, instead of spinning forever on
+// the same, already-seen notification.
+func (self *ring) poll_notify_fd(ctx context.Context) error {
+	fds := []unix.PollFd{{Fd: int32(self.notify_fd), Events: unix.POLLIN}}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		_, err := unix.Poll(fds, 50)
+		if err != nil && !errors.Is(err, unix.EINTR) {
+			return fmt.Errorf("poll() on ringbuf notification fd failed with error: %w", err)
+		}
+		if fds[0].Revents&unix.POLLIN != 0 {
+			self.drain_notify_fd()
+			return nil
+		}
+	}
+}
+
+// drain_notify_fd reads and discards the doorbell's pending counter/bytes.
+func (self *ring) drain_notify_fd() {
+	var buf [8]byte
+	for {
+		_, err := unix.Read(self.notify_fd, buf[:])
+		if !errors.Is(err, unix.EINTR) {
+			return
+		}
+	}
+}
+
+// Producer is the single writer end of a ring buffer.
+type Producer struct{ *ring }
+
+// Consumer is the single reader end of a ring buffer.
+type Consumer struct{ *ring }
+
+// init_producer formats a freshly created shm object as a ring buffer
+// header and wraps it as the Producer end, used by both NewShared and
+// NewSharedFD.
+func init_producer(m shm.MMap, capacity uint64) (*Producer, error) {
+	if capacity == 0 || capacity&(capacity-1) != 0 {
+		m.Close()
+		return nil, ErrNotPowerOfTwo
+	}
+	h := (*header)(unsafe.Pointer(&m.Slice()[0]))
+	h.magic = magic
+	h.version = format_version
+	h.capacity = capacity
+	h.head.Store(0)
+	h.tail.Store(0)
+	h.producer_pid = int32(os.Getpid())
+	r, err := new_ring(m)
+	if err != nil {
+		m.Close()
+		m.Unlink()
+		return nil, err
+	}
+	return &Producer{ring: r}, nil
+}
+
+// attach_consumer wraps an already opened/received shm object as the
+// Consumer end, after verifying the header magic, format version and that
+// capacity is the power-of-two NewShared/NewSharedFD requires, so a
+// corrupted or buggy peer's header is rejected up front instead of silently
+// corrupting the wraparound arithmetic below. Used by both AttachShared and
+// AttachFD.
+func attach_consumer(m shm.MMap) (*Consumer, error) {
+	r, err := new_ring(m)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	if r.h.magic != magic {
+		m.Close()
+		return nil, ErrBadMagic
+	}
+	if r.h.version != format_version {
+		m.Close()
+		return nil, ErrVersionMismatch
+	}
+	if r.h.capacity == 0 || r.h.capacity&(r.h.capacity-1) != 0 {
+		m.Close()
+		return nil, ErrNotPowerOfTwo
+	}
+	r.h.consumer_pid = int32(os.Getpid())
+	return &Consumer{ring: r}, nil
+}
+
+// NewShared creates a new shm backed ring buffer with the specified,
+// power-of-two sized data area and returns the Producer end of it.
+// The Consumer end in the other process attaches to it with AttachShared.
+//
+// shm.CreateTemp prefers an unnamed Linux memfd, which AttachShared cannot
+// open by name; when the backing object comes back unnamed, use
+// NewSharedFD instead and hand the fd itself to the other process.
+func NewShared(name string, capacity uint64) (*Producer, error) {
+	m, err := shm.CreateTemp(name, header_size+capacity)
+	if err != nil {
+		return nil, fmt.Errorf("ringbuf: failed to create shm object with error: %w", err)
+	}
+	return init_producer(m, capacity)
+}
+
+// AttachShared opens a shm backed ring buffer created by NewShared() in
+// another process, by name, and returns the Consumer end of it.
+func AttachShared(name string) (*Consumer, error) {
+	m, err := shm.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("ringbuf: failed to open shm object with error: %w", err)
+	}
+	return attach_consumer(m)
+}
+
+// NewSharedFD creates a new shm backed ring buffer with the specified,
+// power-of-two sized data area and returns the Producer end of it along
+// with the raw fd backing it. Unlike NewShared, the backing object is never
+// given a filesystem name: the only way for the Consumer end to reach it is
+// for the fd returned here to be passed to that process out-of-band,
+// typically over SCM_RIGHTS, and given to AttachFD. The caller owns the
+// returned fd and must close it once it has been sent (the Producer keeps
+// its own, independent fd open via the MMap it wraps).
+func NewSharedFD(capacity uint64) (*Producer, int, error) {
+	m, err := shm.CreateTemp("ringbuf", header_size+capacity)
+	if err != nil {
+		return nil, -1, fmt.Errorf("ringbuf: failed to create shm object with error: %w", err)
+	}
+	p, err := init_producer(m, capacity)
+	if err != nil {
+		return nil, -1, err
+	}
+	fd, err := unix.FcntlInt(m.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		p.Close()
+		return nil, -1, fmt.Errorf("ringbuf: failed to duplicate shm fd with error: %w", err)
+	}
+	return p, fd, nil
+}
+
+// AttachFD wraps an fd received from another process's NewSharedFD, over
+// SCM_RIGHTS, and returns the Consumer end of the ring buffer it backs.
+func AttachFD(fd int) (*Consumer, error) {
+	m, err := shm.FromFD(uintptr(fd))
+	if err != nil {
+		return nil, fmt.Errorf("ringbuf: failed to wrap received fd with error: %w", err)
+	}
+	return attach_consumer(m)
+}
+
+// Write copies as much of p as currently fits into the ring buffer and
+// returns the number of bytes copied. It never blocks: if the buffer is
+// full it returns (0, nil). Use WaitWritable to block until there is room.
+// A successful write posts to the notify fd set via SetNotifyFD, if any, to
+// wake a Consumer blocked in WaitReadable.
+func (self *Producer) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	capacity := self.h.capacity
+	head := self.h.head.Load()
+	tail := self.h.tail.Load()
+	free := capacity - (tail - head)
+	n := p
+	if uint64(len(n)) > free {
+		n = n[:free]
+	}
+	if len(n) == 0 {
+		return 0, nil
+	}
+	start := tail & self.mask
+	if end := start + uint64(len(n)); end > capacity {
+		first := capacity - start
+		copy(self.data[start:], n[:first])
+		copy(self.data[:end-capacity], n[first:])
+	} else {
+		copy(self.data[start:end], n)
+	}
+	self.h.tail.Store(tail + uint64(len(n)))
+	post_notify(self.notify_fd)
+	return len(n), nil
+}
+
+// WaitWritable blocks until there is room to Write at least one byte, or
+// ctx is done.
+func (self *Producer) WaitWritable(ctx context.Context) error {
+	return self.wait(ctx, self.is_writable)
+}
+
+// Read copies as many bytes as are available, up to len(p), out of the ring
+// buffer and returns the number of bytes copied. It never blocks: if the
+// buffer is empty it returns (0, nil). Use WaitReadable to block until
+// there is data. A successful read posts to the notify fd set via
+// SetNotifyFD, if any, to wake a Producer blocked in WaitWritable.
+func (self *Consumer) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	capacity := self.h.capacity
+	head := self.h.head.Load()
+	tail := self.h.tail.Load()
+	avail := tail - head
+	n := p
+	if uint64(len(n)) > avail {
+		n = n[:avail]
+	}
+	if len(n) == 0 {
+		return 0, nil
+	}
+	start := head & self.mask
+	if end := start + uint64(len(n)); end > capacity {
+		first := capacity - start
+		copy(n[:first], self.data[start:])
+		copy(n[first:], self.data[:end-capacity])
+	} else {
+		copy(n, self.data[start:end])
+	}
+	self.h.head.Store(head + uint64(len(n)))
+	post_notify(self.notify_fd)
+	return len(n), nil
+}
+
+// WaitReadable blocks until there is at least one byte to Read, or ctx is done.
+func (self *Consumer) WaitReadable(ctx context.Context) error {
+	return self.wait(ctx, self.is_readable)
+}
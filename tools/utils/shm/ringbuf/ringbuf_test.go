@@ -0,0 +1,137 @@
+// License: GPLv3 Copyright: 2022, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ringbuf
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// new_test_pair creates a Producer/Consumer pair backed by the same shm
+// object via the fd-handoff path (NewSharedFD/AttachFD), which is how two
+// processes actually share an unnamed memfd, but works just as well within
+// a single process for testing.
+func new_test_pair(t *testing.T, capacity uint64) (*Producer, *Consumer) {
+	t.Helper()
+	p, fd, err := NewSharedFD(capacity)
+	if err != nil {
+		t.Fatalf("NewSharedFD failed: %v", err)
+	}
+	t.Cleanup(func() { p.Unlink(); p.Close() })
+	c, err := AttachFD(fd)
+	if err != nil {
+		t.Fatalf("AttachFD failed: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return p, c
+}
+
+func TestRingbufWriteRead(t *testing.T) {
+	p, c := new_test_pair(t, 64)
+	msg := []byte("hello kitty")
+	n, err := p.Write(msg)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if n != len(msg) {
+		t.Fatalf("short write: got %d, want %d", n, len(msg))
+	}
+	buf := make([]byte, len(msg))
+	n, err = c.Read(buf)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if n != len(msg) || !bytes.Equal(buf, msg) {
+		t.Fatalf("Read returned %q, want %q", buf[:n], msg)
+	}
+	// buffer is now empty
+	n, err = c.Read(buf)
+	if err != nil || n != 0 {
+		t.Fatalf("Read on empty buffer returned (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestRingbufWraparound(t *testing.T) {
+	p, c := new_test_pair(t, 8)
+	// advance head and tail close to the end of the capacity so the next
+	// write is forced to wrap around the end of the data area
+	buf := make([]byte, 6)
+	if n, err := p.Write(bytes.Repeat([]byte{'a'}, 6)); err != nil || n != 6 {
+		t.Fatalf("priming write failed: n=%d err=%v", n, err)
+	}
+	if n, err := c.Read(buf); err != nil || n != 6 {
+		t.Fatalf("priming read failed: n=%d err=%v", n, err)
+	}
+	// head == tail == 6 now, a further write of 5 bytes must wrap
+	payload := []byte{1, 2, 3, 4, 5}
+	if n, err := p.Write(payload); err != nil || n != len(payload) {
+		t.Fatalf("wraparound write failed: n=%d err=%v", n, err)
+	}
+	out := make([]byte, len(payload))
+	if n, err := c.Read(out); err != nil || n != len(payload) {
+		t.Fatalf("wraparound read failed: n=%d err=%v", n, err)
+	}
+	if !bytes.Equal(out, payload) {
+		t.Fatalf("wraparound roundtrip returned %v, want %v", out, payload)
+	}
+}
+
+// TestRingbufConcurrent runs the producer and consumer on separate
+// goroutines, exercising WaitWritable/WaitReadable against the lock-free
+// head/tail acquire/release protocol. Run with -race to catch any missing
+// synchronization.
+func TestRingbufConcurrent(t *testing.T) {
+	p, c := new_test_pair(t, 32)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const total = 10000
+	want := make([]byte, total)
+	for i := range want {
+		want[i] = byte(i)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for sent := 0; sent < total; {
+			if err := p.WaitWritable(ctx); err != nil {
+				t.Errorf("WaitWritable failed: %v", err)
+				return
+			}
+			n, err := p.Write(want[sent:])
+			if err != nil {
+				t.Errorf("Write failed: %v", err)
+				return
+			}
+			sent += n
+		}
+	}()
+
+	got := make([]byte, 0, total)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 17) // deliberately not a divisor of capacity or total
+		for len(got) < total {
+			if err := c.WaitReadable(ctx); err != nil {
+				t.Errorf("WaitReadable failed: %v", err)
+				return
+			}
+			n, err := c.Read(buf)
+			if err != nil {
+				t.Errorf("Read failed: %v", err)
+				return
+			}
+			got = append(got, buf[:n]...)
+		}
+	}()
+	wg.Wait()
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("concurrent roundtrip produced %d bytes that did not match the %d bytes sent", len(got), len(want))
+	}
+}
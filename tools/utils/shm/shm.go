@@ -22,7 +22,7 @@ type ErrNotSupported struct {
 }
 
 func (self *ErrNotSupported) Error() string {
-	return fmt.Sprintf("POSIX shared memory not supported on this platform: with underlying error: %v", self.err)
+	return fmt.Sprintf("operation not supported on this platform: with underlying error: %v", self.err)
 }
 
 // prefix_and_suffix splits pattern by the last wildcard "*", if applicable,
@@ -53,8 +53,86 @@ type MMap interface {
 	Name() string
 	IsFileSystemBacked() bool
 	FileSystemName() string
+	// Seal applies the specified seals to the underlying memory object.
+	// Only supported by the memfd based Linux backend, returns
+	// *ErrNotSupported from every other backend, including the /dev/shm
+	// fallback on Linux.
+	Seal(flags SealFlags) error
+	// Resize grows or shrinks the memory object to newSize and remaps
+	// Slice() to match. On Linux this uses mremap(2) to resize the mapping
+	// in place where possible, on other platforms it falls back to a fresh
+	// mmap() followed by munmap() of the old mapping.
+	Resize(newSize uint64) error
+	// Sync flushes changes made to Slice() back to the underlying memory
+	// object via msync(2).
+	Sync(flags SyncFlags) error
+	// Region maps only the specified, page-aligned window of the
+	// underlying memory object, without disturbing the mapping returned
+	// by Slice(). Useful for streaming large, variable sized payloads
+	// without having to map the whole object up front. The caller owns
+	// the returned *MappedRegion and must call its Unmap() once done
+	// with it, or the mapping leaks for the life of the process.
+	Region(offset, length int64, access AccessFlags) (*MappedRegion, error)
+	// Fd returns the underlying file descriptor backing this memory
+	// object. Needed to hand an unnamed object (e.g. a Linux memfd, which
+	// per IsFileSystemBacked()/FileSystemName() has no path another
+	// process can Open()) to another process over SCM_RIGHTS, for use
+	// with FromFD.
+	Fd() uintptr
 }
 
+// MappedRegion is a single mapping returned by MMap.Region(), covering a
+// page-aligned window of the underlying memory object. Call Unmap() once
+// done with it to release the mapping.
+type MappedRegion struct {
+	aligned []byte // the full mmap(2) mapping, page aligned
+	bytes   []byte // the exact [offset, offset+length) window within aligned
+}
+
+// Bytes returns the exact [offset, offset+length) window that was requested
+// from Region(), valid until Unmap() is called.
+func (self *MappedRegion) Bytes() []byte {
+	return self.bytes
+}
+
+// Unmap releases the mapping. The slice returned by Bytes() must not be
+// used again afterwards.
+func (self *MappedRegion) Unmap() error {
+	return munmap(self.aligned)
+}
+
+// SyncFlags control how Sync() flushes a mapping, mirroring the MS_*
+// flags accepted by msync(2).
+type SyncFlags int
+
+const (
+	// SyncAsync schedules the flush and returns immediately.
+	SyncAsync SyncFlags = 1 << iota
+	// SyncInvalidate asks other mappings of the same object to be invalidated
+	// so they pick up the just flushed data, can be ORed with SyncAsync/SyncSync.
+	SyncInvalidate
+	// SyncSync waits for the flush to complete before returning.
+	SyncSync
+)
+
+// SealFlags are the seals that can be applied to a memfd backed MMap via Seal.
+// They mirror the F_SEAL_* flags accepted by fcntl(F_ADD_SEALS) on Linux.
+type SealFlags int
+
+const (
+	// SealSeal prevents any further seals from being added.
+	SealSeal SealFlags = 1 << iota
+	// SealShrink prevents the memory object from being made smaller.
+	SealShrink
+	// SealGrow prevents the memory object from being made larger.
+	SealGrow
+	// SealWrite prevents any writes to the memory object.
+	SealWrite
+	// SealFutureWrite prevents writes to the memory object via any mapping
+	// created after the seal is applied, without affecting existing writable mappings.
+	SealFutureWrite
+)
+
 type AccessFlags int
 
 const (
@@ -85,21 +163,64 @@ func munmap(s []byte) error {
 	return unix.Munmap(s)
 }
 
+func msync(s []byte, flags SyncFlags) error {
+	ms_flags := 0
+	if flags&SyncAsync != 0 {
+		ms_flags |= unix.MS_ASYNC
+	}
+	if flags&SyncSync != 0 {
+		ms_flags |= unix.MS_SYNC
+	}
+	if flags&SyncInvalidate != 0 {
+		ms_flags |= unix.MS_INVALIDATE
+	}
+	return unix.Msync(s, ms_flags)
+}
+
 func CreateTemp(pattern string, size uint64) (MMap, error) {
 	return create_temp(pattern, size)
 }
 
-func truncate_or_unlink(ans *os.File, size uint64) (err error) {
+func do_ftruncate(f *os.File, size uint64) (err error) {
 	for {
-		err = unix.Ftruncate(int(ans.Fd()), int64(size))
+		err = unix.Ftruncate(int(f.Fd()), int64(size))
 		if !errors.Is(err, unix.EINTR) {
 			break
 		}
 	}
-	if err != nil {
+	return
+}
+
+func truncate_or_unlink(ans *os.File, size uint64) (err error) {
+	if err = do_ftruncate(ans, size); err != nil {
 		ans.Close()
 		os.Remove(ans.Name())
 		return fmt.Errorf("Failed to ftruncate() SHM file %s to size: %d with error: %w", ans.Name(), size, err)
 	}
 	return
 }
+
+// map_aligned maps the window [offset, offset+length) of fd, rounding
+// offset down to a page boundary as mmap(2) requires, and returns both the
+// full, page-aligned mapping (which is what must be passed to munmap()) and
+// the exact sub-slice of it corresponding to the requested window.
+func map_aligned(fd int, offset, length int64, access AccessFlags) (aligned, window []byte, err error) {
+	pagesize := int64(os.Getpagesize())
+	aligned_offset := offset &^ (pagesize - 1)
+	delta := offset - aligned_offset
+	aligned, err = mmap(int(length+delta), access, fd, aligned_offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aligned, aligned[delta : delta+length], nil
+}
+
+// map_region is like map_aligned but wraps the result in a *MappedRegion so
+// the caller gets a handle it can Unmap() later.
+func map_region(fd int, offset, length int64, access AccessFlags) (*MappedRegion, error) {
+	aligned, window, err := map_aligned(fd, offset, length, access)
+	if err != nil {
+		return nil, err
+	}
+	return &MappedRegion{aligned: aligned, bytes: window}, nil
+}
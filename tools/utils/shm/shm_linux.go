@@ -0,0 +1,306 @@
+// License: GPLv3 Copyright: 2022, Kovid Goyal, <kovid at kovidgoyal.net>
+//go:build linux
+
+package shm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+const dev_shm_dir = "/dev/shm"
+
+// memfd_based_mmap is backed by a Linux memfd (memfd_create(2)). memfd
+// objects have no filesystem name: they are handed to other processes by
+// passing the fd itself, typically over SCM_RIGHTS, rather than by a path
+// another process can open. This makes them a much better fit than named
+// POSIX shm for kitty's graphics/clipboard IPC, and they additionally
+// support sealing, which lets the receiving end trust that the buffer it
+// was handed can no longer be resized or written to.
+type memfd_based_mmap struct {
+	f      *os.File
+	region []byte
+}
+
+func memfd_create(name string, size uint64) (ans MMap, err error) {
+	fd, err := unix.MemfdCreate(name, unix.MFD_ALLOW_SEALING|unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("memfd_create() failed with error: %w", err)
+	}
+	f := os.NewFile(uintptr(fd), name)
+	if err = truncate_or_unlink(f, size); err != nil {
+		return nil, err
+	}
+	region, err := mmap(int(size), WRITE, fd, 0)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("mmap failed with error: %w", err)
+	}
+	return &memfd_based_mmap{f: f, region: region}, nil
+}
+
+func (self *memfd_based_mmap) Name() string {
+	return self.f.Name()
+}
+
+func (self *memfd_based_mmap) Slice() []byte {
+	return self.region
+}
+
+func (self *memfd_based_mmap) Close() error {
+	err := self.f.Close()
+	self.region = nil
+	return err
+}
+
+// Unlink is a no-op for memfd backed maps as they have no name in the
+// filesystem to remove, they are reclaimed once every holder of the fd
+// closes it.
+func (self *memfd_based_mmap) Unlink() error {
+	return nil
+}
+
+func (self *memfd_based_mmap) IsFileSystemBacked() bool {
+	return false
+}
+
+func (self *memfd_based_mmap) FileSystemName() string {
+	return ""
+}
+
+func (self *memfd_based_mmap) Fd() uintptr {
+	return self.f.Fd()
+}
+
+// Resize grows or shrinks the memfd with ftruncate(2) and then resizes the
+// existing mapping in place with mremap(2), avoiding a munmap()+mmap() pair.
+func (self *memfd_based_mmap) Resize(newSize uint64) error {
+	if err := do_ftruncate(self.f, newSize); err != nil {
+		return fmt.Errorf("Failed to ftruncate() memfd %s to size: %d with error: %w", self.Name(), newSize, err)
+	}
+	region, err := unix.Mremap(self.region, int(newSize), unix.MREMAP_MAYMOVE)
+	if err != nil {
+		return fmt.Errorf("mremap failed with error: %w", err)
+	}
+	self.region = region
+	return nil
+}
+
+func (self *memfd_based_mmap) Sync(flags SyncFlags) error {
+	return msync(self.region, flags)
+}
+
+func (self *memfd_based_mmap) Region(offset, length int64, access AccessFlags) (*MappedRegion, error) {
+	return map_region(int(self.f.Fd()), offset, length, access)
+}
+
+func (self *memfd_based_mmap) Seal(flags SealFlags) error {
+	seals := 0
+	if flags&SealSeal != 0 {
+		seals |= unix.F_SEAL_SEAL
+	}
+	if flags&SealShrink != 0 {
+		seals |= unix.F_SEAL_SHRINK
+	}
+	if flags&SealGrow != 0 {
+		seals |= unix.F_SEAL_GROW
+	}
+	if flags&SealWrite != 0 {
+		seals |= unix.F_SEAL_WRITE
+	}
+	if flags&SealFutureWrite != 0 {
+		seals |= unix.F_SEAL_FUTURE_WRITE
+	}
+	_, err := unix.FcntlInt(self.f.Fd(), unix.F_ADD_SEALS, seals)
+	if err != nil {
+		return fmt.Errorf("fcntl(F_ADD_SEALS) failed with error: %w", err)
+	}
+	return nil
+}
+
+// dev_shm_based_mmap is the fallback used when memfd_create() is not
+// available (kernels older than 3.17). It is the same named, file backed
+// scheme used on darwin/freebsd, implemented directly against /dev/shm
+// since Linux has no shm_open(3) wrapper in golang.org/x/sys/unix.
+type dev_shm_based_mmap struct {
+	f        *os.File
+	region   []byte
+	unlinked bool
+	// windowed is true for maps created by OpenAt(), whose region is only a
+	// sub-slice of the underlying page-aligned mmap(2) mapping rather than
+	// the mapping itself, which Resize()/Sync() require.
+	windowed bool
+}
+
+// Name returns the bare basename of the backing /dev/shm file, suitable for
+// passing straight to Open()/OpenAt(), which join it with dev_shm_dir
+// themselves.
+func (self *dev_shm_based_mmap) Name() string {
+	return filepath.Base(self.f.Name())
+}
+
+func (self *dev_shm_based_mmap) Slice() []byte {
+	return self.region
+}
+
+func (self *dev_shm_based_mmap) Close() error {
+	err := self.f.Close()
+	self.region = nil
+	return err
+}
+
+func (self *dev_shm_based_mmap) Unlink() (err error) {
+	if self.unlinked {
+		return nil
+	}
+	self.unlinked = true
+	return os.Remove(self.f.Name())
+}
+
+func (self *dev_shm_based_mmap) IsFileSystemBacked() bool {
+	return true
+}
+
+func (self *dev_shm_based_mmap) FileSystemName() string {
+	return self.Name()
+}
+
+func (self *dev_shm_based_mmap) Fd() uintptr {
+	return self.f.Fd()
+}
+
+func (self *dev_shm_based_mmap) Seal(flags SealFlags) error {
+	return &ErrNotSupported{err: errors.New("sealing is only supported by the memfd backend")}
+}
+
+func (self *dev_shm_based_mmap) Resize(newSize uint64) error {
+	if self.windowed {
+		return &ErrNotSupported{err: errors.New("Resize is not supported on a map created by OpenAt, as it only covers part of the underlying object")}
+	}
+	if err := do_ftruncate(self.f, newSize); err != nil {
+		return fmt.Errorf("Failed to ftruncate() SHM file %s to size: %d with error: %w", self.f.Name(), newSize, err)
+	}
+	region, err := unix.Mremap(self.region, int(newSize), unix.MREMAP_MAYMOVE)
+	if err != nil {
+		return fmt.Errorf("mremap failed with error: %w", err)
+	}
+	self.region = region
+	return nil
+}
+
+func (self *dev_shm_based_mmap) Sync(flags SyncFlags) error {
+	if self.windowed {
+		return &ErrNotSupported{err: errors.New("Sync is not supported on a map created by OpenAt, as msync(2) requires a page-aligned mapping")}
+	}
+	return msync(self.region, flags)
+}
+
+func (self *dev_shm_based_mmap) Region(offset, length int64, access AccessFlags) (*MappedRegion, error) {
+	return map_region(int(self.f.Fd()), offset, length, access)
+}
+
+func dev_shm_create_temp(pattern string, size uint64) (ans MMap, err error) {
+	prefix, suffix, err := prefix_and_suffix(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var f *os.File
+	try := 0
+	for {
+		name := filepath.Join(dev_shm_dir, prefix+next_random()+suffix)
+		f, err = os.OpenFile(name, os.O_EXCL|os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil && errors.Is(err, os.ErrExist) {
+			try += 1
+			if try > 10000 {
+				return nil, &os.PathError{Op: "createtemp", Path: filepath.Join(dev_shm_dir, prefix+"*"+suffix), Err: os.ErrExist}
+			}
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = truncate_or_unlink(f, size); err != nil {
+		return nil, err
+	}
+	region, err := mmap(int(size), WRITE, int(f.Fd()), 0)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("mmap failed with error: %w", err)
+	}
+	return &dev_shm_based_mmap{f: f, region: region}, nil
+}
+
+// create_temp creates a new anonymous shared memory object. It prefers a
+// sealable memfd and only falls back to a named file under /dev/shm when
+// the running kernel does not implement memfd_create(2).
+func create_temp(pattern string, size uint64) (MMap, error) {
+	ans, err := memfd_create(pattern, size)
+	if err != nil && errors.Is(err, unix.ENOSYS) {
+		return dev_shm_create_temp(pattern, size)
+	}
+	return ans, err
+}
+
+// Open opens an existing named shared memory object created by
+// CreateTemp() on a kernel without memfd_create(2) support. memfd backed
+// objects have no filesystem name and so cannot be opened this way; they
+// must be shared by passing the open fd itself to the other process.
+func Open(name string) (MMap, error) {
+	f, err := os.OpenFile(filepath.Join(dev_shm_dir, name), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	s, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	region, err := mmap(int(s.Size()), READ, int(f.Fd()), 0)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("mmap failed with error: %w", err)
+	}
+	return &dev_shm_based_mmap{f: f, region: region}, nil
+}
+
+// OpenAt opens an existing named shm object created by CreateTemp() on a
+// kernel without memfd_create(2) support, but maps only the page-aligned
+// window [offset, offset+length) of it, instead of the whole object.
+func OpenAt(name string, offset, length int64) (MMap, error) {
+	f, err := os.OpenFile(filepath.Join(dev_shm_dir, name), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, window, err := map_aligned(int(f.Fd()), offset, length, READ)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("mmap failed with error: %w", err)
+	}
+	return &dev_shm_based_mmap{f: f, region: window, windowed: true}, nil
+}
+
+// FromFD wraps an already-open fd, typically received from another process
+// over SCM_RIGHTS, and maps it read-write. This is how a memfd backed
+// object, which has no filesystem name for Open() to find, is shared: the
+// creating end hands its Fd() to the other process out-of-band and the
+// receiving end reconstructs an MMap from it with FromFD.
+func FromFD(fd uintptr) (MMap, error) {
+	f := os.NewFile(fd, fmt.Sprintf("shm-fd-%d", fd))
+	s, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	region, err := mmap(int(s.Size()), WRITE, int(f.Fd()), 0)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("mmap failed with error: %w", err)
+	}
+	return &memfd_based_mmap{f: f, region: region}, nil
+}
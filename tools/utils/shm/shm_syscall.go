@@ -64,23 +64,28 @@ func shm_open(name string, flags, perm int) (ans *os.File, err error) {
 type syscall_based_mmap struct {
 	f        *os.File
 	region   []byte
+	access   AccessFlags
 	unlinked bool
+	// windowed is true for maps created by OpenAt(), whose region is only a
+	// sub-slice of the underlying page-aligned mmap(2) mapping rather than
+	// the mapping itself, which Resize()/Sync() require.
+	windowed bool
 }
 
-func syscall_mmap(f *os.File, size uint64, access ProtectionFlags, truncate bool) (MMap, error) {
+func syscall_mmap(f *os.File, size uint64, access AccessFlags, truncate bool) (MMap, error) {
 	if truncate {
 		err := truncate_or_unlink(f, size)
 		if err != nil {
 			return nil, fmt.Errorf("truncate failed with error: %w", err)
 		}
 	}
-	region, err := mmap(int(size), access, false, int(f.Fd()), 0)
+	region, err := mmap(int(size), access, int(f.Fd()), 0)
 	if err != nil {
 		f.Close()
 		os.Remove(f.Name())
 		return nil, fmt.Errorf("mmap failed with error: %w", err)
 	}
-	return &syscall_based_mmap{f: f, region: region}, nil
+	return &syscall_based_mmap{f: f, region: region, access: access}, nil
 }
 
 func (self *syscall_based_mmap) Name() string {
@@ -105,6 +110,57 @@ func (self *syscall_based_mmap) Unlink() (err error) {
 	return shm_unlink(self.Name())
 }
 
+func (self *syscall_based_mmap) IsFileSystemBacked() bool {
+	return true
+}
+
+func (self *syscall_based_mmap) FileSystemName() string {
+	return self.Name()
+}
+
+func (self *syscall_based_mmap) Fd() uintptr {
+	return self.f.Fd()
+}
+
+func (self *syscall_based_mmap) Seal(flags SealFlags) error {
+	return &ErrNotSupported{err: errors.New("sealing is only supported by the Linux memfd backend")}
+}
+
+// Resize implements MMap.Resize. There is no mremap(2) on darwin/freebsd so
+// the old mapping is torn down and a fresh one created after ftruncate().
+// The new mapping is created before the old one is torn down, so that if it
+// fails self.region is left pointing at a still-valid mapping instead of a
+// dangling one.
+func (self *syscall_based_mmap) Resize(newSize uint64) error {
+	if self.windowed {
+		return &ErrNotSupported{err: errors.New("Resize is not supported on a map created by OpenAt, as it only covers part of the underlying object")}
+	}
+	if err := do_ftruncate(self.f, newSize); err != nil {
+		return fmt.Errorf("Failed to ftruncate() SHM file %s to size: %d with error: %w", self.Name(), newSize, err)
+	}
+	region, err := mmap(int(newSize), self.access, int(self.f.Fd()), 0)
+	if err != nil {
+		return fmt.Errorf("mmap failed with error: %w", err)
+	}
+	old_region := self.region
+	self.region = region
+	if err := munmap(old_region); err != nil {
+		return fmt.Errorf("munmap of previous mapping failed with error: %w", err)
+	}
+	return nil
+}
+
+func (self *syscall_based_mmap) Sync(flags SyncFlags) error {
+	if self.windowed {
+		return &ErrNotSupported{err: errors.New("Sync is not supported on a map created by OpenAt, as msync(2) requires a page-aligned mapping")}
+	}
+	return msync(self.region, flags)
+}
+
+func (self *syscall_based_mmap) Region(offset, length int64, access AccessFlags) (*MappedRegion, error) {
+	return map_region(int(self.f.Fd()), offset, length, access)
+}
+
 func create_temp(pattern string, size uint64) (ans MMap, err error) {
 	var prefix, suffix string
 	prefix, suffix, err = prefix_and_suffix(pattern)
@@ -150,3 +206,32 @@ func Open(name string) (MMap, error) {
 	}
 	return syscall_mmap(ans, uint64(s.Size()), READ, false)
 }
+
+// OpenAt opens an existing named shm object but maps only the page-aligned
+// window [offset, offset+length) of it, instead of the whole object.
+func OpenAt(name string, offset, length int64) (MMap, error) {
+	ans, err := shm_open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, window, err := map_aligned(int(ans.Fd()), offset, length, READ)
+	if err != nil {
+		ans.Close()
+		return nil, fmt.Errorf("mmap failed with error: %w", err)
+	}
+	return &syscall_based_mmap{f: ans, region: window, access: READ, windowed: true}, nil
+}
+
+// FromFD wraps an already-open fd, typically received from another process
+// over SCM_RIGHTS, and maps it read-write. Use this instead of Open() when
+// the other process created its shm object via CreateTemp() and cannot
+// (or, as with a Linux memfd, does not need to) give it a name for Open()
+// to find.
+func FromFD(fd uintptr) (MMap, error) {
+	f := os.NewFile(fd, fmt.Sprintf("shm-fd-%d", fd))
+	s, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return syscall_mmap(f, uint64(s.Size()), WRITE, false)
+}